@@ -18,16 +18,31 @@ package cephfs
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"os/exec"
 
 	"github.com/golang/glog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/ceph/ceph-csi/pkg/csi-common"
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
-	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+// remountReadOnly remounts an existing bind-mount read-only in place, so a
+// MULTI_NODE_READER_ONLY publisher can't write through a mount that was
+// necessarily made read-write by the underlying (possibly shared) staging
+// mount.
+func remountReadOnly(path string) error {
+	args := []string{"-o", "remount,ro,bind", path, path}
+	out, err := exec.Command("mount", args...).CombinedOutput() // #nosec
+	if err != nil {
+		return fmt.Errorf("mount: %s", string(out))
+	}
+	return nil
+}
+
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
 }
@@ -183,6 +198,16 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// A cephfs staging mount is always rw, since it may be shared with
+	// other readers and writers of the same volume. Remount the bind as
+	// ro here so a MULTI_NODE_READER_ONLY publisher can't write through it.
+	if req.GetReadonly() {
+		if err = remountReadOnly(targetPath); err != nil {
+			glog.Errorf("failed to remount volume %s read-only at %s: %v", volId, targetPath, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	glog.Infof("cephfs: successfuly bind-mounted volume %s to %s", volId, targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
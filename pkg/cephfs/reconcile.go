@@ -0,0 +1,70 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cephfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+// ReconcileNodeCache rebuilds nodeCache by walking the staging directory
+// under PluginFolder and re-reading each volume's persisted volumeOptions.
+// It should be called once, during node plugin startup: without it, a
+// kubelet restart between NodeStageVolume and NodeUnstageVolume leaves
+// nodeCache empty, and NodeUnstageVolume can no longer find the dynamically
+// provisioned Ceph user it needs to delete.
+func ReconcileNodeCache() error {
+	stagingDir := path.Join(PluginFolder, "staging")
+	entries, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, fi := range entries {
+		if !fi.IsDir() {
+			continue
+		}
+		volId := volumeID(fi.Name())
+
+		volOptions := &volumeOptions{}
+		if err := loadVolInfo(string(volId), stagingDir, volOptions); err != nil {
+			glog.Warningf("cephfs: failed to reconcile cached state for volume %s: %v", volId, err)
+			continue
+		}
+
+		ent := &nodeCacheEntry{volOptions: volOptions}
+		if volOptions.ProvisionVolume {
+			adminCr, err := loadCephCredentials(volId)
+			if err != nil {
+				glog.Warningf("cephfs: failed to reload ceph credentials for volume %s: %v", volId, err)
+			} else {
+				ent.cephAdminID = adminCr.id
+			}
+		}
+
+		nodeCache.insert(volId, ent)
+		glog.V(4).Infof("cephfs: reconciled cached state for volume %s", volId)
+	}
+
+	return nil
+}
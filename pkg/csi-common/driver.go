@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CSIDriver keeps the identity of a CSI plugin together with the set of
+// controller capabilities and volume access modes it was configured to
+// support. A single instance is shared by the Identity, Controller and
+// Node servers of one driver binary.
+type CSIDriver struct {
+	name    string
+	nodeID  string
+	version string
+
+	cap []*csi.ControllerServiceCapability
+	vc  []*csi.VolumeCapability_AccessMode
+}
+
+// NewCSIDriver creates a CSIDriver. It is called once by each driver's
+// NewDriver, with the name and version the driver advertises over
+// GetPluginInfo.
+func NewCSIDriver(name, v, nodeID string) *CSIDriver {
+	if name == "" {
+		glog.Errorf("Driver name missing")
+		return nil
+	}
+	if v == "" {
+		glog.Errorf("Version argument missing")
+		return nil
+	}
+
+	return &CSIDriver{
+		name:    name,
+		version: v,
+		nodeID:  nodeID,
+	}
+}
+
+// ValidateControllerServiceRequest returns nil if c is RPC_UNKNOWN or the
+// driver was configured to support it, and an InvalidArgument error
+// otherwise.
+func (d *CSIDriver) ValidateControllerServiceRequest(c csi.ControllerServiceCapability_RPC_Type) error {
+	if c == csi.ControllerServiceCapability_RPC_UNKNOWN {
+		return nil
+	}
+
+	for _, cap := range d.cap {
+		if rpc := cap.GetRpc(); rpc != nil && rpc.GetType() == c {
+			return nil
+		}
+	}
+
+	return status.Error(codes.InvalidArgument, c.String())
+}
+
+// AddControllerServiceCapabilities records the set of controller RPCs this
+// driver implements, so later ControllerGetCapabilities/
+// ValidateControllerServiceRequest calls can answer from it.
+func (d *CSIDriver) AddControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_Type) {
+	var csc []*csi.ControllerServiceCapability
+	for _, c := range cl {
+		glog.Infof("Enabling controller service capability: %v", c.String())
+		csc = append(csc, NewControllerServiceCapability(c))
+	}
+	d.cap = csc
+}
+
+// AddVolumeCapabilityAccessModes records the set of access modes this
+// driver's volumes support, and returns them for use by the caller (e.g.
+// when building a ValidateVolumeCapabilities response).
+func (d *CSIDriver) AddVolumeCapabilityAccessModes(vc []csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability_AccessMode {
+	var vca []*csi.VolumeCapability_AccessMode
+	for _, c := range vc {
+		glog.Infof("Enabling volume access mode: %v", c.String())
+		vca = append(vca, NewVolumeCapabilityAccessMode(c))
+	}
+	d.vc = vca
+	return vca
+}
+
+// GetVolumeCapabilityAccessModes returns the access modes configured via
+// AddVolumeCapabilityAccessModes.
+func (d *CSIDriver) GetVolumeCapabilityAccessModes() []*csi.VolumeCapability_AccessMode {
+	return d.vc
+}
+
+// GetControllerServiceCapabilities returns the capabilities configured via
+// AddControllerServiceCapabilities.
+func (d *CSIDriver) GetControllerServiceCapabilities() []*csi.ControllerServiceCapability {
+	return d.cap
+}
+
+func (d *CSIDriver) GetName() string {
+	return d.name
+}
+
+func (d *CSIDriver) GetVersion() string {
+	return d.version
+}
+
+func (d *CSIDriver) GetNodeID() string {
+	return d.nodeID
+}
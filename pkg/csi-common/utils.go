@@ -0,0 +1,93 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// NewControllerServiceCapability builds a ControllerServiceCapability for
+// the given RPC type, the form AddControllerServiceCapabilities expects.
+func NewControllerServiceCapability(c csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: c,
+			},
+		},
+	}
+}
+
+// NewNodeServiceCapability builds a NodeServiceCapability for the given RPC
+// type.
+func NewNodeServiceCapability(c csi.NodeServiceCapability_RPC_Type) *csi.NodeServiceCapability {
+	return &csi.NodeServiceCapability{
+		Type: &csi.NodeServiceCapability_Rpc{
+			Rpc: &csi.NodeServiceCapability_RPC{
+				Type: c,
+			},
+		},
+	}
+}
+
+// NewVolumeCapabilityAccessMode builds a VolumeCapability_AccessMode for the
+// given mode.
+func NewVolumeCapabilityAccessMode(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability_AccessMode {
+	return &csi.VolumeCapability_AccessMode{Mode: mode}
+}
+
+// ParseEndpoint splits a CSI endpoint of the form unix://path or
+// tcp://address into its scheme and address, the way the driver's main
+// package is expected to pass it to NonBlockingGRPCServer.Start.
+func ParseEndpoint(ep string) (string, string, error) {
+	u, err := url.Parse(ep)
+	if err != nil {
+		return "", "", err
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case "tcp":
+		return scheme, u.Host, nil
+	case "unix":
+		addr := u.Host + u.Path
+		return scheme, addr, nil
+	default:
+		return "", "", fmt.Errorf("unsupported CSI endpoint scheme: %s", scheme)
+	}
+}
+
+// logGRPC is a unary server interceptor that logs every request and
+// response the CSI gRPC server handles, at glog verbosity 5.
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	glog.V(5).Infof("GRPC call: %s", info.FullMethod)
+	glog.V(5).Infof("GRPC request: %+v", req)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		glog.Errorf("GRPC error: %v", err)
+	} else {
+		glog.V(5).Infof("GRPC response: %+v", resp)
+	}
+	return resp, err
+}
@@ -18,11 +18,12 @@ package rbd
 
 import (
 	"fmt"
+	"os"
 	"path"
 
+	"github.com/ceph/ceph-csi/pkg/csi-common"
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/glog"
-	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"github.com/pborman/uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
@@ -51,27 +52,15 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
 	}
 
-	// Need to check for already existing volume name, and if found
-	// check for the requested capacity and already allocated capacity
-	if exVol, err := getRBDVolumeByName(req.GetName()); err == nil {
-		// Since err is nil, it means the volume with the same name already exists
-		// need to check if the size of exisiting volume is the same as in new
-		// request
-		if exVol.VolSize >= int64(req.GetCapacityRange().GetRequiredBytes()) {
-			// exisiting volume is compatible with new request and should be reused.
-			// TODO (sbezverk) Do I need to make sure that RBD volume still exists?
-			return &csi.CreateVolumeResponse{
-				Volume: &csi.Volume{
-					Id:            exVol.VolID,
-					CapacityBytes: int64(exVol.VolSize),
-					Attributes:    req.GetParameters(),
-				},
-			}, nil
-		}
-		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", req.GetName()))
+	readOnly, err := negotiateAccessMode(req.VolumeCapabilities)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	// TODO (sbezverk) Last check for not exceeding total storage capacity
+	// Serialize by name: two concurrent CreateVolume calls for the same
+	// PVC must not both race into createRBDImage.
+	createVolumeLock.acquire(req.GetName())
+	defer createVolumeLock.release(req.GetName())
 
 	rbdVol, err := getRBDVolumeOptions(req.GetParameters())
 	if err != nil {
@@ -79,6 +68,19 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	// A StorageClass pointing at a Rook-managed cluster via "clusterID"
+	// gets its monitors/admin credentials resolved from Rook instead of
+	// the hand-written ones (if any) in rbdVol.
+	credentials := req.GetControllerCreateSecrets()
+	if rookParams := parseRookClusterParams(req.GetParameters()); rookParams != nil {
+		resolved, err := resolveRookCluster(rbdVol, rookParams, credentials)
+		if err != nil {
+			glog.Errorf("failed to resolve Rook cluster: %v", err)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		credentials = resolved
+	}
+
 	// Generating Volume Name and Volume ID, as accoeding to CSI spec they MUST be different
 	volName := req.GetName()
 	uniqueID := uuid.NewUUID().String()
@@ -86,8 +88,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		volName = rbdVol.Pool + "-dynamic-pvc-" + uniqueID
 	}
 	rbdVol.VolName = volName
-	volumeID := "csi-rbd-" + uniqueID
-	rbdVol.VolID = volumeID
+	rbdVol.ReadOnly = readOnly
 	// Volume Size - Default is 1 GiB
 	volSizeBytes := int64(oneGB)
 	if req.GetCapacityRange() != nil {
@@ -96,14 +97,34 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	rbdVol.VolSize = volSizeBytes
 	volSizeGB := int(volSizeBytes / 1024 / 1024 / 1024)
 
+	// CSI requires CreateVolume to be idempotent: if a volume of this
+	// name already exists, it is only an ALREADY_EXISTS error when its
+	// actual parameters differ from what was requested, not merely when
+	// a volume with that name exists at all.
+	if exVol, err := getRBDVolumeByName(volName); err == nil {
+		if !rbdVolumeOptionsMatch(exVol, rbdVol) {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("volume %s already exists with different parameters", volName))
+		}
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				Id:            exVol.VolID,
+				CapacityBytes: int64(exVol.VolSize),
+				Attributes:    req.GetParameters(),
+			},
+		}, nil
+	}
+
+	// TODO (sbezverk) Last check for not exceeding total storage capacity
+
+	volumeID := "csi-rbd-" + uniqueID
+	rbdVol.VolID = volumeID
+
 	// Check if there is already RBD image with requested name
-	found, _, _ := rbdStatus(rbdVol, req.GetControllerCreateSecrets())
+	found, _, _ := rbdStatus(rbdVol, credentials)
 	if !found {
-		if err := createRBDImage(rbdVol, volSizeGB, req.GetControllerCreateSecrets()); err != nil {
-			if err != nil {
-				glog.Errorf("failed to create volume: %v", err)
-				return nil, status.Error(codes.Internal, err.Error())
-			}
+		if err := cs.createBackingImage(rbdVol, req, volSizeGB, credentials); err != nil {
+			glog.Errorf("failed to create volume: %v", err)
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 		glog.V(4).Infof("create volume %s", volName)
 	}
@@ -111,7 +132,9 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if err := persistVolInfo(volumeID, path.Join(PluginFolder, "controller"), rbdVol); err != nil {
 		glog.Warningf("rbd: failed to store volInfo with error: %v", err)
 	}
+	rbdVolumesMtx.Lock()
 	rbdVolumes[volumeID] = *rbdVol
+	rbdVolumesMtx.Unlock()
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			Id:            volumeID,
@@ -121,6 +144,69 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}, nil
 }
 
+// createBackingImage creates the rbd image backing rbdVol, honoring an
+// optional VolumeContentSource: a snapshot is restored via clone+flatten, a
+// volume is cloned directly from a snapshot taken of the source image, and
+// absent a content source a plain new image is created. credentials is
+// taken as an argument rather than re-derived from req, since it may have
+// been resolved (and merged with a Rook admin key) by the caller.
+func (cs *controllerServer) createBackingImage(rbdVol *rbdVolume, req *csi.CreateVolumeRequest, volSizeGB int, credentials map[string]string) error {
+	if contentSource := req.GetVolumeContentSource(); contentSource != nil {
+		switch contentSource.GetType().(type) {
+		case *csi.VolumeContentSource_Snapshot:
+			snapshotID := contentSource.GetSnapshot().GetId()
+			rbdSnapshotsMtx.RLock()
+			snap, ok := rbdSnapshots[snapshotID]
+			rbdSnapshotsMtx.RUnlock()
+			if !ok {
+				return fmt.Errorf("failed to find source snapshot %s to restore", snapshotID)
+			}
+			rbdSnap := &snap
+			if err := cloneRBDImage(rbdVol, rbdSnap, credentials); err != nil {
+				return fmt.Errorf("failed to clone from snapshot %s: %v", snapshotID, err)
+			}
+			return flattenRBDImage(rbdVol, credentials)
+
+		case *csi.VolumeContentSource_Volume:
+			sourceVolumeID := contentSource.GetVolume().GetId()
+			rbdVolumesMtx.RLock()
+			sourceVol, ok := rbdVolumes[sourceVolumeID]
+			rbdVolumesMtx.RUnlock()
+			if !ok {
+				return fmt.Errorf("failed to find source volume %s to clone", sourceVolumeID)
+			}
+			tempSnap := &rbdSnapshot{
+				SnapName: rbdVol.VolName + "-temp-clone-snap",
+				VolName:  sourceVol.VolName,
+				Pool:     sourceVol.Pool,
+				Monitors: sourceVol.Monitors,
+				AdminId:  sourceVol.AdminId,
+			}
+			if err := createSnapshot(tempSnap, credentials); err != nil {
+				return fmt.Errorf("failed to snapshot source volume %s for cloning: %v", sourceVolumeID, err)
+			}
+			// tempSnap only exists to seed the clone; it is never
+			// exposed to CSI, so it must not outlive this call.
+			if err := cloneRBDImage(rbdVol, tempSnap, credentials); err != nil {
+				if derr := deleteSnapshot(tempSnap, credentials); derr != nil {
+					glog.Errorf("failed to clean up temporary clone snapshot %s: %v", tempSnap.SnapName, derr)
+				}
+				return fmt.Errorf("failed to clone from volume %s: %v", sourceVolumeID, err)
+			}
+			flattenErr := flattenRBDImage(rbdVol, credentials)
+			if derr := deleteSnapshot(tempSnap, credentials); derr != nil {
+				glog.Errorf("failed to clean up temporary clone snapshot %s: %v", tempSnap.SnapName, derr)
+			}
+			if flattenErr != nil {
+				return fmt.Errorf("failed to flatten clone of volume %s: %v", sourceVolumeID, flattenErr)
+			}
+			return nil
+		}
+	}
+
+	return createRBDImage(rbdVol, volSizeGB, credentials)
+}
+
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		msg := fmt.Sprintf("invalid delete volume req: %v", req)
@@ -131,10 +217,34 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	volumeID := req.GetVolumeId()
 	rbdVol := &rbdVolume{}
 	if err := loadVolInfo(volumeID, path.Join(PluginFolder, "controller"), rbdVol); err != nil {
-		glog.Errorf("failed to load volume info for volume %s: %v", req.GetVolumeId(), err)
-		return nil, status.Error(codes.Internal, err.Error())
+		if !os.IsNotExist(err) {
+			glog.Errorf("failed to load volume info for volume %s: %v", req.GetVolumeId(), err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// The persisted volInfo file can be missing even though the
+		// rbd image still exists, e.g. persistVolInfo failed in
+		// CreateVolume, which only logs that failure and still records
+		// the volume in rbdVolumes. Fall back to the in-memory cache
+		// rather than leaking the image by bailing out here. A volume
+		// found in neither place is not looked up in Ceph.
+		rbdVolumesMtx.RLock()
+		cached, ok := rbdVolumes[volumeID]
+		rbdVolumesMtx.RUnlock()
+		if !ok {
+			// Neither on disk nor in memory: CSI requires DeleteVolume
+			// to be idempotent, so treat it as already deleted.
+			glog.V(4).Infof("volume %s not found, assuming it is already deleted", volumeID)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		*rbdVol = cached
 	}
 	volName := rbdVol.VolName
+
+	// Hold the same per-name lock CreateVolume does, so a retried
+	// CreateVolume for this PVC can't race an in-flight DeleteVolume.
+	createVolumeLock.acquire(volName)
+	defer createVolumeLock.release(volName)
+
 	// Deleting rbd image
 	glog.V(4).Infof("deleting volume %s", volName)
 	if err := deleteRBDImage(rbdVol, req.GetControllerDeleteSecrets()); err != nil {
@@ -146,16 +256,80 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		glog.Errorf("failed to delete volume info for volume %s: %v", req.GetVolumeId(), err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	rbdVolumesMtx.Lock()
 	delete(rbdVolumes, volumeID)
+	rbdVolumesMtx.Unlock()
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// rbdVolumeOptionsMatch reports whether a newly requested volume is
+// compatible with an already persisted one of the same name: the CSI spec
+// requires CreateVolume to be idempotent for identical requests, and to
+// fail with ALREADY_EXISTS for any material difference.
+func rbdVolumeOptionsMatch(existing, requested *rbdVolume) bool {
+	return existing.VolSize == requested.VolSize &&
+		existing.Pool == requested.Pool &&
+		existing.Monitors == requested.Monitors &&
+		existing.ImageFormat == requested.ImageFormat &&
+		existing.ImageFeatures == requested.ImageFeatures &&
+		existing.Mounter == requested.Mounter &&
+		existing.AdminId == requested.AdminId &&
+		existing.UserId == requested.UserId
+}
+
+// negotiateAccessMode derives whether an rbd image should be mapped
+// read-only, based on the requested volume capabilities. All publishers
+// must agree: a mix of a writer and a multi-node reader is rejected, since
+// the image would otherwise need to be mapped both rw and ro at once.
+func negotiateAccessMode(caps []*csi.VolumeCapability) (bool, error) {
+	sawWriter := false
+	sawMultiReader := false
+	for _, c := range caps {
+		mode := c.GetAccessMode().GetMode()
+		if !isSupportedAccessMode(mode) {
+			return false, fmt.Errorf("unsupported access mode %s", mode)
+		}
+		if mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+			sawWriter = true
+		} else {
+			sawMultiReader = true
+		}
+	}
+	if sawWriter && sawMultiReader {
+		return false, fmt.Errorf("cannot request an rbd image both read-write and multi-node read-only at the same time")
+	}
+	return sawMultiReader, nil
+}
+
+// rbd images can only be mapped read-write on a single node, or read-only on
+// any number of nodes; a single map cannot be shared read-write.
+func isSupportedAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	default:
+		return false
+	}
+}
+
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	sawWriter := false
+	sawMultiReader := false
 	for _, cap := range req.VolumeCapabilities {
-		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: ""}, nil
+		mode := cap.GetAccessMode().GetMode()
+		if !isSupportedAccessMode(mode) {
+			return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: fmt.Sprintf("unsupported access mode %s", mode)}, nil
+		}
+		if mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+			sawWriter = true
+		} else {
+			sawMultiReader = true
 		}
 	}
+	if sawWriter && sawMultiReader {
+		return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: "an rbd image cannot be requested both read-write and multi-node read-only at the same time"}, nil
+	}
 	return &csi.ValidateVolumeCapabilitiesResponse{Supported: true, Message: ""}, nil
 }
 
@@ -166,3 +340,164 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	return &csi.ControllerPublishVolumeResponse{}, nil
 }
+
+// ListVolumes is backed by the in-memory rbdVolumes map, which
+// LoadExistingVolumes refills from the persisted volInfo files at startup
+// and from which ReconcileImagesInPool drops entries whose rbd image no
+// longer exists; images in Ceph without a volInfo file are not listed.
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		msg := fmt.Sprintf("invalid list volumes req: %v", req)
+		glog.Error(msg)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
+
+	rbdVolumesMtx.RLock()
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(rbdVolumes))
+	for volumeID, vol := range rbdVolumes {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				Id:            volumeID,
+				CapacityBytes: vol.VolSize,
+			},
+		})
+	}
+	rbdVolumesMtx.RUnlock()
+
+	return &csi.ListVolumesResponse{Entries: entries}, nil
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		msg := fmt.Sprintf("invalid create snapshot req: %v", req)
+		glog.Error(msg)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot Name cannot be empty")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source Volume ID cannot be empty")
+	}
+
+	rbdVolumesMtx.RLock()
+	sourceVol, ok := rbdVolumes[req.GetSourceVolumeId()]
+	rbdVolumesMtx.RUnlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "source volume %s not found", req.GetSourceVolumeId())
+	}
+
+	// Idempotency: a snapshot with the same name already exists, reuse it.
+	if exSnap, err := getRBDSnapshotByName(req.GetName()); err == nil {
+		if exSnap.SourceVolumeID != req.GetSourceVolumeId() {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("snapshot %s already exists for a different source volume", req.GetName()))
+		}
+		return &csi.CreateSnapshotResponse{
+			Snapshot: &csi.Snapshot{
+				Id:             exSnap.SnapID,
+				SourceVolumeId: exSnap.SourceVolumeID,
+				SizeBytes:      exSnap.SizeBytes,
+				CreatedAt:      exSnap.CreatedAt,
+				Status:         &csi.SnapshotStatus{Type: csi.SnapshotStatus_READY},
+			},
+		}, nil
+	}
+
+	uniqueID := uuid.NewUUID().String()
+	rbdSnap := &rbdSnapshot{
+		SnapName:       req.GetName(),
+		SnapID:         "csi-rbd-snap-" + uniqueID,
+		SourceVolumeID: req.GetSourceVolumeId(),
+		VolName:        sourceVol.VolName,
+		Pool:           sourceVol.Pool,
+		Monitors:       sourceVol.Monitors,
+		AdminId:        sourceVol.AdminId,
+		SizeBytes:      sourceVol.VolSize,
+	}
+
+	if err := createSnapshot(rbdSnap, req.GetCreateSnapshotSecrets()); err != nil {
+		glog.Errorf("failed to create snapshot %s: %v", rbdSnap.SnapName, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := persistVolInfo(rbdSnap.SnapID, path.Join(PluginFolder, "controller"), rbdSnap); err != nil {
+		glog.Warningf("rbd: failed to store snapInfo with error: %v", err)
+	}
+	rbdSnapshotsMtx.Lock()
+	rbdSnapshots[rbdSnap.SnapID] = *rbdSnap
+	rbdSnapshotsMtx.Unlock()
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			Id:             rbdSnap.SnapID,
+			SourceVolumeId: rbdSnap.SourceVolumeID,
+			SizeBytes:      rbdSnap.SizeBytes,
+			CreatedAt:      rbdSnap.CreatedAt,
+			Status:         &csi.SnapshotStatus{Type: csi.SnapshotStatus_READY},
+		},
+	}, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		msg := fmt.Sprintf("invalid delete snapshot req: %v", req)
+		glog.Error(msg)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
+
+	snapshotID := req.GetSnapshotId()
+	rbdSnapshotsMtx.RLock()
+	rbdSnap, ok := rbdSnapshots[snapshotID]
+	rbdSnapshotsMtx.RUnlock()
+	if !ok {
+		// Already gone, DeleteSnapshot must be idempotent.
+		glog.V(4).Infof("snapshot %s not found, assuming it is already deleted", snapshotID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if err := deleteSnapshot(&rbdSnap, req.GetDeleteSnapshotSecrets()); err != nil {
+		glog.Errorf("failed to delete snapshot %s: %v", snapshotID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := deleteVolInfo(snapshotID, path.Join(PluginFolder, "controller")); err != nil {
+		glog.Errorf("failed to delete snapshot info for %s: %v", snapshotID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	rbdSnapshotsMtx.Lock()
+	delete(rbdSnapshots, snapshotID)
+	rbdSnapshotsMtx.Unlock()
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		msg := fmt.Sprintf("invalid list snapshots req: %v", req)
+		glog.Error(msg)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
+
+	rbdSnapshotsMtx.RLock()
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, len(rbdSnapshots))
+	for _, snap := range rbdSnapshots {
+		if req.GetSourceVolumeId() != "" && snap.SourceVolumeID != req.GetSourceVolumeId() {
+			continue
+		}
+		if req.GetSnapshotId() != "" && snap.SnapID != req.GetSnapshotId() {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: &csi.Snapshot{
+				Id:             snap.SnapID,
+				SourceVolumeId: snap.SourceVolumeID,
+				SizeBytes:      snap.SizeBytes,
+				CreatedAt:      snap.CreatedAt,
+				Status:         &csi.SnapshotStatus{Type: csi.SnapshotStatus_READY},
+			},
+		})
+	}
+	rbdSnapshotsMtx.RUnlock()
+
+	return &csi.ListSnapshotsResponse{Entries: entries}, nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import "testing"
+
+func TestRbdVolumeOptionsMatch(t *testing.T) {
+	base := rbdVolume{
+		VolSize:       1073741824,
+		Pool:          "rbd",
+		Monitors:      "10.0.0.1:6789",
+		ImageFormat:   "2",
+		ImageFeatures: "layering",
+		Mounter:       "rbd",
+		AdminId:       "admin",
+		UserId:        "admin",
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(*rbdVolume)
+		want   bool
+	}{
+		{"identical", func(v *rbdVolume) {}, true},
+		{"different size", func(v *rbdVolume) { v.VolSize = 2147483648 }, false},
+		{"different pool", func(v *rbdVolume) { v.Pool = "other-pool" }, false},
+		{"different monitors", func(v *rbdVolume) { v.Monitors = "10.0.0.2:6789" }, false},
+		{"different image format", func(v *rbdVolume) { v.ImageFormat = "1" }, false},
+		{"different image features", func(v *rbdVolume) { v.ImageFeatures = "" }, false},
+		{"different mounter", func(v *rbdVolume) { v.Mounter = "rbd-nbd" }, false},
+		{"different adminId", func(v *rbdVolume) { v.AdminId = "other" }, false},
+		{"different userId", func(v *rbdVolume) { v.UserId = "other" }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested := base
+			tt.mutate(&requested)
+			if got := rbdVolumeOptionsMatch(&base, &requested); got != tt.want {
+				t.Errorf("rbdVolumeOptionsMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"github.com/ceph/ceph-csi/pkg/csi-common"
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
+)
+
+// Driver is the rbd CSI plugin: it owns the shared CSIDriver (identity,
+// capabilities, access modes) and the Identity/Controller/Node servers
+// built on top of it.
+type Driver struct {
+	driver *csicommon.CSIDriver
+
+	ids *csicommon.DefaultIdentityServer
+	cs  *controllerServer
+	ns  *csicommon.DefaultNodeServer
+}
+
+// NewDriver builds a Driver for the given name/version, but does not start
+// serving; call Run to do that.
+func NewDriver(name, version, nodeID string) *Driver {
+	driver := csicommon.NewCSIDriver(name, version, nodeID)
+	if driver == nil {
+		return nil
+	}
+
+	driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	})
+	driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	})
+
+	return &Driver{
+		driver: driver,
+		ids:    &csicommon.DefaultIdentityServer{Driver: driver},
+		cs:     &controllerServer{DefaultControllerServer: &csicommon.DefaultControllerServer{Driver: driver}},
+		ns:     &csicommon.DefaultNodeServer{Driver: driver},
+	}
+}
+
+// Run reconciles in-memory state from what was already persisted to disk,
+// then serves the Identity, Controller and Node services on endpoint until
+// the process is stopped.
+func (d *Driver) Run(endpoint string) {
+	if err := LoadExistingVolumes(); err != nil {
+		glog.Errorf("rbd: failed to reconcile persisted volumes: %v", err)
+	}
+	ReconcileImagesInKnownPools()
+
+	server := csicommon.NewNonBlockingGRPCServer()
+	server.Start(endpoint, d.ids, d.cs, d.ns)
+	server.Wait()
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import "sync"
+
+// nameLock serializes operations keyed by a name (typically the requested
+// volume name), so that two concurrent CSI calls for the same name don't
+// race each other into creating/deleting the backing rbd image twice.
+type nameLock struct {
+	mtx   sync.Mutex
+	locks map[string]*namedMutex
+}
+
+// namedMutex is a nameLock entry: refCount tracks how many goroutines
+// currently hold or are waiting on mtx, so release can drop the entry
+// from the map once nobody references it instead of leaking one entry
+// per distinct key for the life of the process.
+type namedMutex struct {
+	mtx      sync.Mutex
+	refCount int
+}
+
+func newNameLock() *nameLock {
+	return &nameLock{locks: make(map[string]*namedMutex)}
+}
+
+// acquire locks the given key, creating its lock on first use.
+func (l *nameLock) acquire(key string) {
+	l.mtx.Lock()
+	m, ok := l.locks[key]
+	if !ok {
+		m = &namedMutex{}
+		l.locks[key] = m
+	}
+	m.refCount++
+	l.mtx.Unlock()
+
+	m.mtx.Lock()
+}
+
+// release unlocks the given key. It is a no-op if the key was never
+// acquired. Once the last holder/waiter of key releases it, its entry is
+// dropped from the map.
+func (l *nameLock) release(key string) {
+	l.mtx.Lock()
+	m, ok := l.locks[key]
+	if !ok {
+		l.mtx.Unlock()
+		return
+	}
+	m.refCount--
+	if m.refCount == 0 {
+		delete(l.locks, key)
+	}
+	l.mtx.Unlock()
+
+	m.mtx.Unlock()
+}
+
+// createVolumeLock serializes CreateVolume and DeleteVolume calls by volume
+// name, so concurrent CSI requests for the same PVC can't both create (or
+// race a create against a delete of) the same rbd image.
+var createVolumeLock = newNameLock()
+
+// rbdVolumesMtx guards all reads and writes of the rbdVolumes map. CSI
+// sidecars invoke ListVolumes concurrently with CreateVolume/DeleteVolume,
+// and a concurrent plain map read/write is a fatal, unrecoverable error in
+// Go, not something a request can retry past.
+var rbdVolumesMtx sync.RWMutex
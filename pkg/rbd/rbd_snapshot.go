@@ -0,0 +1,163 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// rbdSnapshot represents the internal state of a snapshot of an rbd image.
+// It mirrors rbdVolume and is persisted the same way, keyed by SnapID.
+type rbdSnapshot struct {
+	SnapName       string
+	SnapID         string
+	SourceVolumeID string
+	VolName        string
+	Pool           string
+	Monitors       string
+	CreatedAt      int64
+	SizeBytes      int64
+	AdminId        string
+	UserId         string
+	Mounter        string
+}
+
+// rbdSnapshots holds the in-memory view of all known snapshots, keyed by
+// SnapID, mirroring the existing rbdVolumes map. rbdSnapshotsMtx guards all
+// reads and writes of it, since ListSnapshots ranges over it concurrently
+// with CreateSnapshot/DeleteSnapshot.
+var (
+	rbdSnapshots    = map[string]rbdSnapshot{}
+	rbdSnapshotsMtx sync.RWMutex
+)
+
+func getRBDSnapshotByName(snapName string) (*rbdSnapshot, error) {
+	rbdSnapshotsMtx.RLock()
+	defer rbdSnapshotsMtx.RUnlock()
+
+	for _, snap := range rbdSnapshots {
+		if snap.SnapName == snapName {
+			return &snap, nil
+		}
+	}
+	return nil, fmt.Errorf("rbd: snapshot named %s not found", snapName)
+}
+
+func execCommand(command string, args []string) ([]byte, error) {
+	cmd := exec.Command(command, args...) // #nosec
+	return cmd.CombinedOutput()
+}
+
+// createSnapshot creates a protected rbd snapshot, which is a prerequisite
+// for cloning.
+func createSnapshot(pOpts *rbdSnapshot, credentials map[string]string) error {
+	image := pOpts.VolName
+	snapID := pOpts.SnapName
+
+	args := []string{"snap", "create", image + "@" + snapID, "--pool", pOpts.Pool,
+		"--id", pOpts.AdminId, "-m", pOpts.Monitors, "--key=" + credentials[pOpts.AdminId]}
+	output, err := execCommand("rbd", args)
+	if err != nil {
+		glog.Errorf("failed to create snapshot %s, command output: %s", snapID, string(output))
+		return err
+	}
+
+	return protectSnapshot(pOpts, credentials)
+}
+
+// protectSnapshot protects a snapshot so that it can be used as a clone
+// source; rbd refuses to clone from an unprotected snapshot.
+func protectSnapshot(pOpts *rbdSnapshot, credentials map[string]string) error {
+	image := pOpts.VolName
+	snapID := pOpts.SnapName
+
+	args := []string{"snap", "protect", image + "@" + snapID, "--pool", pOpts.Pool,
+		"--id", pOpts.AdminId, "-m", pOpts.Monitors, "--key=" + credentials[pOpts.AdminId]}
+	output, err := execCommand("rbd", args)
+	if err != nil {
+		glog.Errorf("failed to protect snapshot %s, command output: %s", snapID, string(output))
+		return err
+	}
+	return nil
+}
+
+// unprotectSnapshot removes the protection from a snapshot, a prerequisite
+// to deleting it once any clones taken from it have been flattened.
+func unprotectSnapshot(pOpts *rbdSnapshot, credentials map[string]string) error {
+	image := pOpts.VolName
+	snapID := pOpts.SnapName
+
+	args := []string{"snap", "unprotect", image + "@" + snapID, "--pool", pOpts.Pool,
+		"--id", pOpts.AdminId, "-m", pOpts.Monitors, "--key=" + credentials[pOpts.AdminId]}
+	output, err := execCommand("rbd", args)
+	if err != nil {
+		glog.Errorf("failed to unprotect snapshot %s, command output: %s", snapID, string(output))
+		return err
+	}
+	return nil
+}
+
+// deleteSnapshot unprotects and removes a snapshot from Ceph.
+func deleteSnapshot(pOpts *rbdSnapshot, credentials map[string]string) error {
+	image := pOpts.VolName
+	snapID := pOpts.SnapName
+
+	if err := unprotectSnapshot(pOpts, credentials); err != nil {
+		glog.Warningf("failed to unprotect snapshot %s, proceeding with removal: %v", snapID, err)
+	}
+
+	args := []string{"snap", "rm", image + "@" + snapID, "--pool", pOpts.Pool,
+		"--id", pOpts.AdminId, "-m", pOpts.Monitors, "--key=" + credentials[pOpts.AdminId]}
+	output, err := execCommand("rbd", args)
+	if err != nil {
+		glog.Errorf("failed to delete snapshot %s, command output: %s", snapID, string(output))
+		return err
+	}
+	return nil
+}
+
+// cloneRBDImage clones pOpts from the given protected snapshot, producing a
+// writable image that still shares backing extents with its parent until
+// flattened.
+func cloneRBDImage(pOpts *rbdVolume, sourceSnap *rbdSnapshot, credentials map[string]string) error {
+	args := []string{"clone", sourceSnap.Pool + "/" + sourceSnap.VolName + "@" + sourceSnap.SnapName,
+		pOpts.Pool + "/" + pOpts.VolName, "--id", pOpts.AdminId, "-m", pOpts.Monitors, "--key=" + credentials[pOpts.AdminId]}
+	output, err := execCommand("rbd", args)
+	if err != nil {
+		glog.Errorf("failed to clone rbd image %s from snapshot %s, command output: %s", pOpts.VolName, sourceSnap.SnapName, string(output))
+		return err
+	}
+	return nil
+}
+
+// flattenRBDImage copies all the data from a clone's parent snapshot into
+// the clone itself, so the parent snapshot can later be removed
+// independently of the clone's lifecycle.
+func flattenRBDImage(pOpts *rbdVolume, credentials map[string]string) error {
+	args := []string{"flatten", pOpts.Pool + "/" + pOpts.VolName,
+		"--id", pOpts.AdminId, "-m", pOpts.Monitors, "--key=" + credentials[pOpts.AdminId]}
+	output, err := execCommand("rbd", args)
+	if err != nil {
+		glog.Errorf("failed to flatten rbd image %s, command output: %s", pOpts.VolName, string(output))
+		return err
+	}
+	return nil
+}
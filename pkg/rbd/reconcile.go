@@ -0,0 +1,129 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+// LoadExistingVolumes rebuilds rbdVolumes from the per-volume files
+// persisted under PluginFolder, so a restarted controller doesn't forget
+// about volumes it already created. It should be called once, during
+// driver startup, before serving any requests.
+func LoadExistingVolumes() error {
+	volDir := path.Join(PluginFolder, "controller")
+	entries, err := ioutil.ReadDir(volDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		volumeID := entry.Name()
+		rbdVol := &rbdVolume{}
+		if err := loadVolInfo(volumeID, volDir, rbdVol); err != nil {
+			glog.Warningf("rbd: failed to reconcile persisted volume %s: %v", volumeID, err)
+			continue
+		}
+		rbdVolumesMtx.Lock()
+		rbdVolumes[volumeID] = *rbdVol
+		rbdVolumesMtx.Unlock()
+		glog.V(4).Infof("rbd: reconciled volume %s from persisted state", volumeID)
+	}
+
+	return nil
+}
+
+// ReconcileImagesInPool covers the case where an rbd image was removed out
+// from under ceph-csi (e.g. by hand, or by a tool other than this driver):
+// it cross-checks the in-memory rbdVolumes map for pool against `rbd ls`
+// and drops any entry whose image no longer exists. It never creates or
+// deletes an rbd image itself, only the bookkeeping around it; the reverse
+// problem, a persisted volInfo file missing for an image that still
+// exists, is instead handled by DeleteVolume falling back to the
+// in-memory cache.
+func ReconcileImagesInPool(pool, adminID, monitors string, credentials map[string]string) error {
+	args := []string{"ls", "--pool", pool, "--format", "json",
+		"--id", adminID, "-m", monitors, "--key=" + credentials[adminID]}
+	output, err := execCommand("rbd", args)
+	if err != nil {
+		return fmt.Errorf("failed to list images in pool %s: %v, output: %s", pool, err, string(output))
+	}
+
+	var images []string
+	if err := json.Unmarshal(output, &images); err != nil {
+		return fmt.Errorf("failed to parse `rbd ls` output for pool %s: %v", pool, err)
+	}
+	existing := make(map[string]bool, len(images))
+	for _, img := range images {
+		existing[img] = true
+	}
+
+	rbdVolumesMtx.Lock()
+	defer rbdVolumesMtx.Unlock()
+	for volumeID, vol := range rbdVolumes {
+		if vol.Pool != pool {
+			continue
+		}
+		if !existing[vol.VolName] {
+			glog.Warningf("rbd: image %s/%s backing volume %s no longer exists, dropping it from the in-memory cache", pool, vol.VolName, volumeID)
+			delete(rbdVolumes, volumeID)
+		}
+	}
+
+	return nil
+}
+
+// ReconcileImagesInKnownPools calls ReconcileImagesInPool once for every
+// distinct pool/adminID/monitors combination already present in rbdVolumes
+// (normally populated moments earlier by LoadExistingVolumes), so it runs
+// automatically at driver startup instead of needing each pool to be
+// supplied out of band. A failure for one pool is only logged: it must
+// not stop the driver from serving RPCs for the pools it could reconcile.
+func ReconcileImagesInKnownPools() {
+	type cluster struct {
+		pool, adminID, monitors string
+	}
+	rbdVolumesMtx.RLock()
+	seen := make(map[cluster]bool)
+	for _, vol := range rbdVolumes {
+		seen[cluster{vol.Pool, vol.AdminId, vol.Monitors}] = true
+	}
+	rbdVolumesMtx.RUnlock()
+
+	for c := range seen {
+		// No CSI request is in flight at startup to supply secrets, so
+		// this only works against a cluster that accepts an empty key
+		// for adminID; a deployment that needs this to reconcile
+		// against a cephx-secured cluster must supply credentials some
+		// other way, which is out of scope here.
+		if err := ReconcileImagesInPool(c.pool, c.adminID, c.monitors, map[string]string{}); err != nil {
+			glog.Warningf("rbd: failed to reconcile images in pool %s: %v", c.pool, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	rookDefaultNamespace  = "rook-ceph"
+	rookAdminKeyringField = "admin-secret"
+)
+
+// rookClusterParams are the optional StorageClass parameters that, when
+// present, switch volume provisioning to resolving mon addresses and admin
+// credentials from a Rook-managed cluster instead of requiring the
+// operator to hand-copy them into every StorageClass.
+type rookClusterParams struct {
+	clusterID     string
+	rookNamespace string
+}
+
+func parseRookClusterParams(params map[string]string) *rookClusterParams {
+	clusterID, ok := params["clusterID"]
+	if !ok || clusterID == "" {
+		return nil
+	}
+	ns := params["rookNamespace"]
+	if ns == "" {
+		ns = rookDefaultNamespace
+	}
+	return &rookClusterParams{clusterID: clusterID, rookNamespace: ns}
+}
+
+// newRookK8sClient is a package variable so tests can stub it out; in
+// production it always builds from the pod's in-cluster config, since the
+// csi-provisioner/ceph-csi controller pod runs inside the same cluster as
+// the Rook operator it is resolving against.
+var newRookK8sClient = func() (kubernetes.Interface, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load in-cluster config: %v", err)
+	}
+	return kubernetes.NewForConfig(cfg)
+}
+
+// resolveRookCluster overwrites pOpts's mon addresses and admin ID with the
+// ones published by the Rook operator for rookParams.clusterID, and returns
+// a credentials map carrying the matching admin key merged on top of
+// baseCredentials, so the rest of the create path (createRBDImage,
+// createSnapshot, ...) can use it exactly like a user-supplied Ceph secret.
+//
+// baseCredentials is never mutated: operators using Rook commonly omit the
+// StorageClass secretRef entirely, so it is often nil, and writing into a
+// nil map panics.
+func resolveRookCluster(pOpts *rbdVolume, rookParams *rookClusterParams, baseCredentials map[string]string) (map[string]string, error) {
+	clientset, err := newRookK8sClient()
+	if err != nil {
+		return nil, fmt.Errorf("rook cluster %s: %v", rookParams.clusterID, err)
+	}
+
+	cmName := rookParams.clusterID + "-rook-ceph-mon-endpoints"
+	cm, err := clientset.CoreV1().ConfigMaps(rookParams.rookNamespace).Get(cmName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("rook cluster %s: failed to get mon endpoints configmap %s: %v", rookParams.clusterID, cmName, err)
+	}
+	monitors, err := monsFromRookConfigMap(cm.Data)
+	if err != nil {
+		return nil, fmt.Errorf("rook cluster %s: %v", rookParams.clusterID, err)
+	}
+
+	secretName := rookParams.clusterID + "-rook-ceph-mons"
+	secret, err := clientset.CoreV1().Secrets(rookParams.rookNamespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("rook cluster %s: failed to get admin secret %s: %v", rookParams.clusterID, secretName, err)
+	}
+	adminKey, ok := secret.Data[rookAdminKeyringField]
+	if !ok {
+		return nil, fmt.Errorf("rook cluster %s: secret %s has no %s field", rookParams.clusterID, secretName, rookAdminKeyringField)
+	}
+
+	pOpts.Monitors = monitors
+	pOpts.AdminId = "admin"
+
+	credentials := make(map[string]string, len(baseCredentials)+1)
+	for k, v := range baseCredentials {
+		credentials[k] = v
+	}
+	credentials[pOpts.AdminId] = string(adminKey)
+
+	return credentials, nil
+}
+
+// monsFromRookConfigMap extracts the comma-separated mon address list Rook
+// publishes in its mon-endpoints ConfigMap's "data" key (a serialized
+// map from mon name to address that ceph-csi only needs flattened).
+func monsFromRookConfigMap(data map[string]string) (string, error) {
+	raw, ok := data["data"]
+	if !ok || raw == "" {
+		return "", fmt.Errorf("mon-endpoints configmap has no mon data")
+	}
+
+	var addrs []string
+	for _, monEntry := range strings.Split(raw, ",") {
+		parts := strings.SplitN(monEntry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		addrs = append(addrs, parts[1])
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("failed to parse any mon address out of %q", raw)
+	}
+
+	return strings.Join(addrs, ","), nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMonsFromRookConfigMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "no data key",
+			data:    map[string]string{},
+			wantErr: true,
+		},
+		{
+			name:    "empty data key",
+			data:    map[string]string{"data": ""},
+			wantErr: true,
+		},
+		{
+			name: "single mon",
+			data: map[string]string{"data": "a=10.0.0.1:6789"},
+			want: "10.0.0.1:6789",
+		},
+		{
+			name: "multiple mons",
+			data: map[string]string{"data": "a=10.0.0.1:6789,b=10.0.0.2:6789,c=10.0.0.3:6789"},
+			want: "10.0.0.1:6789,10.0.0.2:6789,10.0.0.3:6789",
+		},
+		{
+			name: "malformed entries are skipped",
+			data: map[string]string{"data": "a=10.0.0.1:6789,garbage,b=10.0.0.2:6789"},
+			want: "10.0.0.1:6789,10.0.0.2:6789",
+		},
+		{
+			name:    "only malformed entries",
+			data:    map[string]string{"data": "garbage,moregarbage"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := monsFromRookConfigMap(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("monsFromRookConfigMap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("monsFromRookConfigMap() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestResolveRookClusterNilCredentials guards against a regression of the
+// panic fixed in b66439b: resolveRookCluster used to write the resolved
+// admin key directly into the credentials map handed to it, which is nil
+// whenever the operator drops the StorageClass secretRef (the whole point
+// of using Rook).
+func TestResolveRookClusterNilCredentials(t *testing.T) {
+	const clusterID = "test-cluster"
+
+	origNewRookK8sClient := newRookK8sClient
+	defer func() { newRookK8sClient = origNewRookK8sClient }()
+
+	newRookK8sClient = func() (kubernetes.Interface, error) {
+		return fake.NewSimpleClientset(
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      clusterID + "-rook-ceph-mon-endpoints",
+					Namespace: rookDefaultNamespace,
+				},
+				Data: map[string]string{"data": "a=10.0.0.1:6789"},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      clusterID + "-rook-ceph-mons",
+					Namespace: rookDefaultNamespace,
+				},
+				Data: map[string][]byte{rookAdminKeyringField: []byte("secret-key")},
+			},
+		), nil
+	}
+
+	pOpts := &rbdVolume{}
+	rookParams := &rookClusterParams{clusterID: clusterID, rookNamespace: rookDefaultNamespace}
+
+	credentials, err := resolveRookCluster(pOpts, rookParams, nil)
+	if err != nil {
+		t.Fatalf("resolveRookCluster() with nil baseCredentials panicked or errored: %v", err)
+	}
+	if credentials["admin"] != "secret-key" {
+		t.Errorf("resolveRookCluster() credentials[admin] = %q, want %q", credentials["admin"], "secret-key")
+	}
+	if pOpts.Monitors != "10.0.0.1:6789" {
+		t.Errorf("resolveRookCluster() pOpts.Monitors = %q, want %q", pOpts.Monitors, "10.0.0.1:6789")
+	}
+}